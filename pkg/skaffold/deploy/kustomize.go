@@ -17,13 +17,20 @@ limitations under the License.
 package deploy
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"io"
-	"io/ioutil"
+	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	yaml "gopkg.in/yaml.v2"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/krusty"
 
 	"github.com/GoogleContainerTools/skaffold/pkg/skaffold/build"
 	"github.com/GoogleContainerTools/skaffold/pkg/skaffold/color"
@@ -36,27 +43,59 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Build engines supported by KustomizeDeploy.BuildEngine.
+const (
+	cliBuildEngine     = "cli"
+	libraryBuildEngine = "library"
+)
+
+// Apply strategies supported by KustomizeDeploy.ApplyStrategy.
+const (
+	clientApplyStrategy     = "client"
+	serverSideApplyStrategy = "server-side"
+	dryRunApplyStrategy     = "dry-run"
+)
+
 // kustomization is the content of a kustomization.yaml file.
 type kustomization struct {
-	Bases              []string             `yaml:"bases"`
-	Resources          []string             `yaml:"resources"`
-	Patches            []string             `yaml:"patches"`
-	CRDs               []string             `yaml:"crds"`
-	PatchesJSON6902    []patchJSON6902      `yaml:"patchesJson6902"`
-	ConfigMapGenerator []configMapGenerator `yaml:"configMapGenerator"`
-	SecretGenerator    []secretGenerator    `yaml:"secretGenerator"`
+	Bases                 []string             `yaml:"bases"`
+	Resources             []string             `yaml:"resources"`
+	Patches               []string             `yaml:"patches"`
+	CRDs                  []string             `yaml:"crds"`
+	PatchesJSON6902       []patchJSON6902      `yaml:"patchesJson6902"`
+	PatchesStrategicMerge []string             `yaml:"patchesStrategicMerge"`
+	ConfigMapGenerator    []configMapGenerator `yaml:"configMapGenerator"`
+	SecretGenerator       []secretGenerator    `yaml:"secretGenerator"`
+	Components            []string             `yaml:"components"`
+	Configurations        []string             `yaml:"configurations"`
+	Generators            []string             `yaml:"generators"`
+	Transformers          []string             `yaml:"transformers"`
+	Replacements          []replacement        `yaml:"replacements"`
+	OpenAPI               openAPI              `yaml:"openapi"`
 }
 
 type patchJSON6902 struct {
 	Path string `yaml:"path"`
 }
 
+type replacement struct {
+	Path string `yaml:"path"`
+}
+
+type openAPI struct {
+	Path string `yaml:"path"`
+}
+
 type configMapGenerator struct {
 	Files []string `yaml:"files"`
+	Envs  []string `yaml:"envs"`
+	Env   string   `yaml:"env"`
 }
 
 type secretGenerator struct {
 	Files []string `yaml:"files"`
+	Envs  []string `yaml:"envs"`
+	Env   string   `yaml:"env"`
 }
 
 // KustomizeDeployer deploys workflows using kustomize CLI.
@@ -68,17 +107,131 @@ type KustomizeDeployer struct {
 }
 
 func NewKustomizeDeployer(runCtx *runcontext.RunContext) *KustomizeDeployer {
+	cfg := runCtx.Cfg.Deploy.KustomizeDeploy
+
+	applyStrategy := cfg.ApplyStrategy
+	if applyStrategy == "" {
+		applyStrategy = clientApplyStrategy
+	}
+
+	flags := cfg.Flags
+	// "-o name" is required so applyAndTrack can tell exactly which resources were
+	// applied before a deploy is canceled or fails partway through.
+	flags.Apply = append(flags.Apply, "-o", "name")
+	switch applyStrategy {
+	case serverSideApplyStrategy:
+		flags.Apply = append(flags.Apply, serverSideApplyFlags(cfg.ForceConflicts)...)
+	case clientApplyStrategy, dryRunApplyStrategy:
+		// No extra apply flags needed: client-side apply is kubectl's default,
+		// and dry-run never reaches kubectl.Apply.
+	}
+
 	return &KustomizeDeployer{
-		KustomizeDeploy: runCtx.Cfg.Deploy.KustomizeDeploy,
+		KustomizeDeploy: cfg,
 		kubectl: kubectl.CLI{
 			Namespace:   runCtx.Opts.Namespace,
 			KubeContext: runCtx.KubeContext,
-			Flags:       runCtx.Cfg.Deploy.KustomizeDeploy.Flags,
+			Flags:       flags,
 		},
 		defaultRepo: runCtx.DefaultRepo,
 	}
 }
 
+// serverSideApplyFlags builds the extra `kubectl apply` flags needed for server-side apply.
+func serverSideApplyFlags(forceConflicts bool) []string {
+	flags := []string{"--server-side", "--field-manager=skaffold"}
+	if forceConflicts {
+		flags = append(flags, "--force-conflicts")
+	}
+
+	return flags
+}
+
+// Builder builds the manifests of a kustomization directory.
+type Builder interface {
+	Build(ctx context.Context, dir string) ([]byte, error)
+}
+
+// CLIBuilder shells out to a `kustomize` binary, the same way a user would on the command line.
+type CLIBuilder struct {
+	binaryPath         string
+	buildArgs          []string
+	enableAlphaPlugins bool
+}
+
+// Build runs `kustomize build` against dir.
+func (b *CLIBuilder) Build(ctx context.Context, dir string) ([]byte, error) {
+	binaryPath := b.binaryPath
+	if binaryPath == "" {
+		binaryPath = "kustomize"
+	}
+
+	cmd := exec.CommandContext(ctx, binaryPath, b.args(dir)...)
+	if b.enableAlphaPlugins {
+		cmd.Env = append(os.Environ(), "KUSTOMIZE_PLUGIN_HOME="+kustomizePluginHome())
+	}
+
+	return util.RunCmdOut(cmd)
+}
+
+// args builds the `kustomize build` argument list for dir.
+func (b *CLIBuilder) args(dir string) []string {
+	args := []string{"build"}
+	if b.enableAlphaPlugins {
+		args = append(args, "--enable_alpha_plugins")
+	}
+	args = append(args, b.buildArgs...)
+	args = append(args, dir)
+
+	return args
+}
+
+// LibraryBuilder runs kustomize in-process via sigs.k8s.io/kustomize/api, so deploys don't
+// depend on a `kustomize` binary being present on the user's PATH.
+type LibraryBuilder struct {
+	fSys filesys.FileSystem
+}
+
+// Build runs an in-memory kustomize build against dir.
+func (b *LibraryBuilder) Build(ctx context.Context, dir string) ([]byte, error) {
+	k := krusty.MakeKustomizer(b.fSys, krusty.MakeDefaultOptions())
+
+	resMap, err := k.Run(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "building kustomization")
+	}
+
+	return resMap.AsYaml()
+}
+
+// kustomizePaths returns the kustomization directories to build, falling back to the
+// deprecated, singular KustomizePath for backwards compatibility.
+func (k *KustomizeDeployer) kustomizePaths() []string {
+	if len(k.KustomizePaths) > 0 {
+		return k.KustomizePaths
+	}
+
+	return []string{k.KustomizePath}
+}
+
+// builder selects the Builder implementation configured for this deployer.
+func (k *KustomizeDeployer) builder() Builder {
+	buildEngine := k.BuildEngine
+	if buildEngine == "" {
+		buildEngine = cliBuildEngine
+	}
+
+	if buildEngine == libraryBuildEngine {
+		return &LibraryBuilder{fSys: filesys.MakeFsOnDisk()}
+	}
+
+	return &CLIBuilder{
+		binaryPath:         k.BinaryPath,
+		buildArgs:          k.BuildArgs,
+		enableAlphaPlugins: k.EnableAlphaPlugins,
+	}
+}
+
 // Labels returns the labels specific to kustomize.
 func (k *KustomizeDeployer) Labels() map[string]string {
 	return map[string]string{
@@ -86,17 +239,35 @@ func (k *KustomizeDeployer) Labels() map[string]string {
 	}
 }
 
-// Deploy runs `kubectl apply` on the manifest generated by kustomize.
+// Deploy runs `kubectl apply` on the manifest generated by kustomize. If the
+// caller's context is canceled (e.g. the user hits Ctrl-C) while kubectl apply is
+// in flight, every manifest entry whose resources had all been applied is deleted
+// again so the cluster isn't left half-deployed. The resources of an entry that was
+// only partly applied when the apply stopped are not deleted.
 func (k *KustomizeDeployer) Deploy(ctx context.Context, out io.Writer, builds []build.Artifact, labellers []Labeller) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	color.Default.Fprintln(out, "kubectl client version:", k.kubectl.Version(ctx))
 	if err := k.kubectl.CheckVersion(ctx); err != nil {
 		color.Default.Fprintln(out, err)
 	}
 
-	manifests, err := k.readManifests(ctx)
+	manifests, err := k.Render(ctx, builds, labellers)
 	if err != nil {
 		event.DeployFailed(err)
-		return errors.Wrap(err, "reading manifests")
+		return err
 	}
 
 	if len(manifests) == 0 {
@@ -105,20 +276,27 @@ func (k *KustomizeDeployer) Deploy(ctx context.Context, out io.Writer, builds []
 
 	event.DeployInProgress()
 
-	manifests, err = manifests.ReplaceImages(builds, k.defaultRepo)
-	if err != nil {
-		event.DeployFailed(err)
-		return errors.Wrap(err, "replacing images in manifests")
-	}
+	if k.ApplyStrategy == dryRunApplyStrategy {
+		if err := k.kubectl.Diff(ctx, out, manifests); err != nil {
+			event.DeployFailed(err)
+			return err
+		}
 
-	manifests, err = manifests.SetLabels(merge(labellers...))
-	if err != nil {
-		event.DeployFailed(err)
-		return errors.Wrap(err, "setting labels in manifests")
+		event.DeployComplete()
+		return nil
 	}
 
-	err = k.kubectl.Apply(ctx, out, manifests)
+	applied, err := k.applyAndTrack(ctx, out, manifests)
 	if err != nil {
+		if ctx.Err() == context.Canceled {
+			color.Default.Fprintln(out, "Deploy canceled, rolling back applied resources...")
+			event.DeployFailed(err)
+			if rollbackErr := k.kubectl.Delete(context.Background(), out, applied); rollbackErr != nil {
+				return errors.Wrap(rollbackErr, "rolling back partial deploy")
+			}
+			return errors.Wrap(err, "deploy canceled")
+		}
+
 		event.DeployFailed(err)
 	}
 
@@ -126,6 +304,84 @@ func (k *KustomizeDeployer) Deploy(ctx context.Context, out io.Writer, builds []
 	return nil
 }
 
+// applyAndTrack runs a single, batched `kubectl apply` over manifests (preserving flags
+// like --prune, which only make sense against the whole set) while recording, via
+// kubectl's streamed `-o name` output, exactly which of those manifests were applied
+// before ctx was canceled or the apply failed. NewKustomizeDeployer arranges for
+// "-o name" to always be in k.kubectl.Flags.Apply so this output is available.
+//
+// kubectl prints one "-o name" line per individual resource, while each entry in
+// manifests can itself bundle several resources (e.g. one kustomize-build per
+// KustomizePaths entry), so the resource count is matched against manifests at
+// resource granularity rather than against len(manifests) directly.
+func (k *KustomizeDeployer) applyAndTrack(ctx context.Context, out io.Writer, manifests kubectl.ManifestList) (kubectl.ManifestList, error) {
+	pr, pw := io.Pipe()
+
+	resourcesApplied := make(chan int, 1)
+	go func() {
+		count := 0
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				count++
+			}
+		}
+		resourcesApplied <- count
+	}()
+
+	err := k.kubectl.Apply(ctx, io.MultiWriter(out, pw), manifests)
+	pw.Close()
+
+	return manifestsApplied(manifests, <-resourcesApplied), err
+}
+
+// manifestsApplied returns the longest prefix of manifests whose resources are fully
+// covered by resourcesApplied, the number of individual k8s resources kubectl reported
+// having applied (e.g. via counting "-o name" output lines). An entry whose resources
+// were only partially applied is excluded, since we can't know which of its resources
+// within it actually landed.
+func manifestsApplied(manifests kubectl.ManifestList, resourcesApplied int) kubectl.ManifestList {
+	var applied kubectl.ManifestList
+
+	seen := 0
+	for _, manifest := range manifests {
+		resourcesInManifest := countResources(manifest)
+		if seen+resourcesInManifest > resourcesApplied {
+			break
+		}
+
+		seen += resourcesInManifest
+		applied = append(applied, manifest)
+	}
+
+	return applied
+}
+
+// countResources counts the YAML documents in manifest, i.e. the number of individual
+// k8s resources it bundles.
+func countResources(manifest []byte) int {
+	count := 0
+	hasContent := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		switch line := strings.TrimSpace(scanner.Text()); {
+		case line == "---":
+			if hasContent {
+				count++
+			}
+			hasContent = false
+		case line != "":
+			hasContent = true
+		}
+	}
+	if hasContent {
+		count++
+	}
+
+	return count
+}
+
 // Cleanup deletes what was deployed by calling Deploy.
 func (k *KustomizeDeployer) Cleanup(ctx context.Context, out io.Writer) error {
 	manifests, err := k.readManifests(ctx)
@@ -140,11 +396,54 @@ func (k *KustomizeDeployer) Cleanup(ctx context.Context, out io.Writer) error {
 	return nil
 }
 
-func dependenciesForKustomization(dir string) ([]string, error) {
+// Render returns the fully-rendered manifests — after kustomize build, image replacement,
+// and label injection — without applying them to a cluster. It backs both `skaffold render`
+// and the "dry-run" ApplyStrategy.
+func (k *KustomizeDeployer) Render(ctx context.Context, builds []build.Artifact, labellers []Labeller) (kubectl.ManifestList, error) {
+	manifests, err := k.readManifests(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading manifests")
+	}
+
+	manifests, err = manifests.ReplaceImages(builds, k.defaultRepo)
+	if err != nil {
+		return nil, errors.Wrap(err, "replacing images in manifests")
+	}
+
+	return manifests.SetLabels(merge(labellers...))
+}
+
+// Diff renders the manifests and streams a `kubectl diff` against the live cluster state,
+// without applying anything.
+func (k *KustomizeDeployer) Diff(ctx context.Context, out io.Writer, builds []build.Artifact, labellers []Labeller) error {
+	manifests, err := k.Render(ctx, builds, labellers)
+	if err != nil {
+		return err
+	}
+
+	return k.kubectl.Diff(ctx, out, manifests)
+}
+
+func dependenciesForKustomizationPaths(fSys filesys.FileSystem, paths []string) ([]string, error) {
+	var deps []string
+
+	for _, path := range paths {
+		pathDeps, err := dependenciesForKustomization(fSys, path)
+		if err != nil {
+			return nil, err
+		}
+
+		deps = append(deps, pathDeps...)
+	}
+
+	return deps, nil
+}
+
+func dependenciesForKustomization(fSys filesys.FileSystem, dir string) ([]string, error) {
 	var deps []string
 
 	path := filepath.Join(dir, "kustomization.yaml")
-	buf, err := ioutil.ReadFile(path)
+	buf, err := fSys.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -155,7 +454,7 @@ func dependenciesForKustomization(dir string) ([]string, error) {
 	}
 
 	for _, base := range content.Bases {
-		baseDeps, err := dependenciesForKustomization(filepath.Join(dir, base))
+		baseDeps, err := dependenciesForKustomization(fSys, filepath.Join(dir, base))
 		if err != nil {
 			return nil, err
 		}
@@ -163,18 +462,47 @@ func dependenciesForKustomization(dir string) ([]string, error) {
 		deps = append(deps, baseDeps...)
 	}
 
+	for _, component := range content.Components {
+		componentDeps, err := dependenciesForKustomization(fSys, filepath.Join(dir, component))
+		if err != nil {
+			return nil, err
+		}
+
+		deps = append(deps, componentDeps...)
+	}
+
 	deps = append(deps, path)
 	deps = append(deps, joinPaths(dir, content.Resources)...)
 	deps = append(deps, joinPaths(dir, content.Patches)...)
 	deps = append(deps, joinPaths(dir, content.CRDs)...)
+	deps = append(deps, joinPaths(dir, content.PatchesStrategicMerge)...)
+	deps = append(deps, joinPaths(dir, content.Configurations)...)
+	deps = append(deps, joinPaths(dir, content.Generators)...)
+	deps = append(deps, joinPaths(dir, content.Transformers)...)
+	if content.OpenAPI.Path != "" {
+		deps = append(deps, filepath.Join(dir, content.OpenAPI.Path))
+	}
 	for _, patch := range content.PatchesJSON6902 {
 		deps = append(deps, filepath.Join(dir, patch.Path))
 	}
+	for _, r := range content.Replacements {
+		if r.Path != "" {
+			deps = append(deps, filepath.Join(dir, r.Path))
+		}
+	}
 	for _, generator := range content.ConfigMapGenerator {
 		deps = append(deps, joinPaths(dir, generator.Files)...)
+		deps = append(deps, joinPaths(dir, generator.Envs)...)
+		if generator.Env != "" {
+			deps = append(deps, filepath.Join(dir, generator.Env))
+		}
 	}
 	for _, generator := range content.SecretGenerator {
 		deps = append(deps, joinPaths(dir, generator.Files)...)
+		deps = append(deps, joinPaths(dir, generator.Envs)...)
+		if generator.Env != "" {
+			deps = append(deps, filepath.Join(dir, generator.Env))
+		}
 	}
 
 	return deps, nil
@@ -192,21 +520,35 @@ func joinPaths(root string, paths []string) []string {
 
 // Dependencies lists all the files that can change what needs to be deployed.
 func (k *KustomizeDeployer) Dependencies() ([]string, error) {
-	return dependenciesForKustomization(k.KustomizePath)
+	return dependenciesForKustomizationPaths(filesys.MakeFsOnDisk(), k.kustomizePaths())
 }
 
-func (k *KustomizeDeployer) readManifests(ctx context.Context) (kubectl.ManifestList, error) {
-	cmd := exec.CommandContext(ctx, "kustomize", "build", k.KustomizePath)
-	out, err := util.RunCmdOut(cmd)
-	if err != nil {
-		return nil, errors.Wrap(err, "kustomize build")
+// kustomizePluginHome returns the directory kustomize looks in for alpha
+// plugins, honoring the same env var kustomize itself reads.
+func kustomizePluginHome() string {
+	if home := os.Getenv("KUSTOMIZE_PLUGIN_HOME"); home != "" {
+		return home
 	}
 
-	if len(out) == 0 {
-		return nil, nil
-	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "kustomize", "plugin")
+}
+
+func (k *KustomizeDeployer) readManifests(ctx context.Context) (kubectl.ManifestList, error) {
+	builder := k.builder()
 
 	var manifests kubectl.ManifestList
-	manifests.Append(out)
+	for _, path := range k.kustomizePaths() {
+		out, err := builder.Build(ctx, path)
+		if err != nil {
+			return nil, errors.Wrap(err, "kustomize build")
+		}
+
+		if len(out) == 0 {
+			continue
+		}
+
+		manifests.Append(out)
+	}
+
 	return manifests, nil
 }
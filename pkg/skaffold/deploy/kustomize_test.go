@@ -0,0 +1,335 @@
+/*
+Copyright 2019 The Skaffold Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deploy
+
+import (
+	"sort"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/filesys"
+
+	"github.com/GoogleContainerTools/skaffold/pkg/skaffold/deploy/kubectl"
+	"github.com/GoogleContainerTools/skaffold/pkg/skaffold/schema/latest"
+	"github.com/GoogleContainerTools/skaffold/testutil"
+)
+
+func TestDependenciesForKustomization(t *testing.T) {
+	tests := []struct {
+		description string
+		dir         string
+		files       map[string]string
+		expected    []string
+	}{
+		{
+			description: "resources, patches and crds",
+			dir:         "/kustomize",
+			files: map[string]string{
+				"/kustomize/kustomization.yaml": `resources:
+- deployment.yaml
+patches:
+- patch.yaml
+crds:
+- crd.yaml
+`,
+			},
+			expected: []string{
+				"/kustomize/kustomization.yaml",
+				"/kustomize/deployment.yaml",
+				"/kustomize/patch.yaml",
+				"/kustomize/crd.yaml",
+			},
+		},
+		{
+			description: "components recurse like bases",
+			dir:         "/kustomize",
+			files: map[string]string{
+				"/kustomize/kustomization.yaml": `components:
+- ../component
+resources:
+- deployment.yaml
+`,
+				"/component/kustomization.yaml": `resources:
+- patch.yaml
+`,
+			},
+			expected: []string{
+				"/kustomize/kustomization.yaml",
+				"/kustomize/deployment.yaml",
+				"/component/kustomization.yaml",
+				"/component/patch.yaml",
+			},
+		},
+		{
+			description: "configMapGenerator and secretGenerator envs/env",
+			dir:         "/kustomize",
+			files: map[string]string{
+				"/kustomize/kustomization.yaml": `configMapGenerator:
+- files:
+  - config.properties
+  envs:
+  - common.env
+  env: app.env
+secretGenerator:
+- files:
+  - secret.properties
+  envs:
+  - common-secret.env
+  env: app-secret.env
+`,
+			},
+			expected: []string{
+				"/kustomize/kustomization.yaml",
+				"/kustomize/config.properties",
+				"/kustomize/common.env",
+				"/kustomize/app.env",
+				"/kustomize/secret.properties",
+				"/kustomize/common-secret.env",
+				"/kustomize/app-secret.env",
+			},
+		},
+		{
+			description: "replacements",
+			dir:         "/kustomize",
+			files: map[string]string{
+				"/kustomize/kustomization.yaml": `replacements:
+- path: replacement.yaml
+`,
+			},
+			expected: []string{
+				"/kustomize/kustomization.yaml",
+				"/kustomize/replacement.yaml",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		testutil.Run(t, test.description, func(t *testutil.T) {
+			fSys := filesys.MakeFsInMemory()
+			for path, content := range test.files {
+				t.CheckNoError(fSys.WriteFile(path, []byte(content)))
+			}
+
+			deps, err := dependenciesForKustomization(fSys, test.dir)
+			t.CheckNoError(err)
+
+			sort.Strings(deps)
+			expected := append([]string{}, test.expected...)
+			sort.Strings(expected)
+			t.CheckDeepEqual(expected, deps)
+		})
+	}
+}
+
+func TestDependenciesForKustomizationPaths(t *testing.T) {
+	testutil.Run(t, "aggregates dependencies across multiple paths", func(t *testutil.T) {
+		fSys := filesys.MakeFsInMemory()
+		t.CheckNoError(fSys.WriteFile("/app/kustomization.yaml", []byte("resources:\n- deployment.yaml\n")))
+		t.CheckNoError(fSys.WriteFile("/monitoring/kustomization.yaml", []byte("resources:\n- prometheus.yaml\n")))
+
+		deps, err := dependenciesForKustomizationPaths(fSys, []string{"/app", "/monitoring"})
+		t.CheckNoError(err)
+
+		sort.Strings(deps)
+		expected := []string{
+			"/app/deployment.yaml",
+			"/app/kustomization.yaml",
+			"/monitoring/kustomization.yaml",
+			"/monitoring/prometheus.yaml",
+		}
+		t.CheckDeepEqual(expected, deps)
+	})
+}
+
+func TestCountResources(t *testing.T) {
+	tests := []struct {
+		description string
+		manifest    string
+		expected    int
+	}{
+		{"empty", "", 0},
+		{"single resource", "apiVersion: v1\nkind: ConfigMap\n", 1},
+		{
+			description: "three resources separated by ---",
+			manifest: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: svc
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: deploy
+`,
+			expected: 3,
+		},
+	}
+
+	for _, test := range tests {
+		testutil.Run(t, test.description, func(t *testutil.T) {
+			t.CheckDeepEqual(test.expected, countResources([]byte(test.manifest)))
+		})
+	}
+}
+
+func TestManifestsApplied(t *testing.T) {
+	// A single path whose kustomize-build output bundles three resources, followed
+	// by a second path bundling one resource, mirroring what readManifests produces
+	// for a multi-entry KustomizePaths.
+	threeResourcePath := []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: svc
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: deploy
+`)
+	oneResourcePath := []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: other-path\n")
+
+	manifests := kubectl.ManifestList{threeResourcePath, oneResourcePath}
+
+	tests := []struct {
+		description      string
+		resourcesApplied int
+		expectedEntries  int
+	}{
+		{"nothing applied yet", 0, 0},
+		{"first path only partially applied", 1, 0},
+		{"first path only partially applied (2 of 3)", 2, 0},
+		{"first path fully applied, second not started", 3, 1},
+		{"both paths fully applied", 4, 2},
+	}
+
+	for _, test := range tests {
+		testutil.Run(t, test.description, func(t *testutil.T) {
+			applied := manifestsApplied(manifests, test.resourcesApplied)
+			t.CheckDeepEqual(test.expectedEntries, len(applied))
+		})
+	}
+}
+
+func TestCLIBuilderArgs(t *testing.T) {
+	tests := []struct {
+		description        string
+		buildArgs          []string
+		enableAlphaPlugins bool
+		expected           []string
+	}{
+		{
+			description: "defaults",
+			expected:    []string{"build", "/kustomize"},
+		},
+		{
+			description:        "alpha plugins enabled",
+			enableAlphaPlugins: true,
+			expected:           []string{"build", "--enable_alpha_plugins", "/kustomize"},
+		},
+		{
+			description: "extra build args",
+			buildArgs:   []string{"--load-restrictor", "LoadRestrictionsNone"},
+			expected:    []string{"build", "--load-restrictor", "LoadRestrictionsNone", "/kustomize"},
+		},
+	}
+
+	for _, test := range tests {
+		testutil.Run(t, test.description, func(t *testutil.T) {
+			b := &CLIBuilder{buildArgs: test.buildArgs, enableAlphaPlugins: test.enableAlphaPlugins}
+			t.CheckDeepEqual(test.expected, b.args("/kustomize"))
+		})
+	}
+}
+
+func TestKustomizeDeployerBuilder(t *testing.T) {
+	tests := []struct {
+		description string
+		buildEngine string
+		checkType   func(t *testutil.T, builder Builder)
+	}{
+		{
+			description: "defaults to the CLI builder",
+			buildEngine: "",
+			checkType: func(t *testutil.T, builder Builder) {
+				if _, ok := builder.(*CLIBuilder); !ok {
+					t.Errorf("expected *CLIBuilder, got %T", builder)
+				}
+			},
+		},
+		{
+			description: "cli build engine",
+			buildEngine: cliBuildEngine,
+			checkType: func(t *testutil.T, builder Builder) {
+				if _, ok := builder.(*CLIBuilder); !ok {
+					t.Errorf("expected *CLIBuilder, got %T", builder)
+				}
+			},
+		},
+		{
+			description: "library build engine",
+			buildEngine: libraryBuildEngine,
+			checkType: func(t *testutil.T, builder Builder) {
+				if _, ok := builder.(*LibraryBuilder); !ok {
+					t.Errorf("expected *LibraryBuilder, got %T", builder)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		testutil.Run(t, test.description, func(t *testutil.T) {
+			k := &KustomizeDeployer{
+				KustomizeDeploy: &latest.KustomizeDeploy{BuildEngine: test.buildEngine},
+			}
+
+			test.checkType(t, k.builder())
+		})
+	}
+}
+
+func TestServerSideApplyFlags(t *testing.T) {
+	tests := []struct {
+		description    string
+		forceConflicts bool
+		expected       []string
+	}{
+		{
+			description: "no force conflicts",
+			expected:    []string{"--server-side", "--field-manager=skaffold"},
+		},
+		{
+			description:    "force conflicts",
+			forceConflicts: true,
+			expected:       []string{"--server-side", "--field-manager=skaffold", "--force-conflicts"},
+		},
+	}
+
+	for _, test := range tests {
+		testutil.Run(t, test.description, func(t *testutil.T) {
+			t.CheckDeepEqual(test.expected, serverSideApplyFlags(test.forceConflicts))
+		})
+	}
+}